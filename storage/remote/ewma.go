@@ -14,23 +14,33 @@
 package remote
 
 import (
+	"math"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-// ewmaRate tracks an exponentially weighted moving average of a per-second rate.
+// ewmaRate tracks an exponentially weighted moving average of a per-second
+// rate. rate(), count(), and snapshot() are lock-free reads, so collectors
+// and other callers can observe consistent values without contending on a
+// mutex with incr() or with each other; only tick() itself is serialized.
 type ewmaRate struct {
 	// Keep all 64bit atomically accessed variables at the top of this struct.
 	// See https://golang.org/pkg/sync/atomic/#pkg-note-BUG for more info.
-	events int64
+	events       int64
+	rateBits     uint64 // bit pattern of the current rate, per math.Float64bits
+	lastEvents   int64
+	lastTickNano int64
 
-	alpha      float64
-	interval   time.Duration
-	lastRate   float64
-	lastEvents int64
-	init       bool
-	mutex      sync.Mutex
+	alpha    float64
+	interval time.Duration
+	init     bool // only ever read or written from within tick()
+	mutex    sync.Mutex
+
+	// snapshotValue holds the current ewmaRateSnapshot, stored as a single
+	// atomic unit once per tick() so readers can never observe a torn
+	// combination of rate, count, and lastTick from different ticks.
+	snapshotValue atomic.Value
 }
 
 // newEWMARate always allocates a new ewmaRate, as this guarantees the atomically
@@ -44,20 +54,195 @@ func newEWMARate(alpha float64, interval time.Duration) *ewmaRate {
 
 // rate returns the per-second rate.
 func (r *ewmaRate) rate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&r.rateBits))
+}
+
+// count returns the total events recorded as of the last tick().
+func (r *ewmaRate) count() int64 {
+	return atomic.LoadInt64(&r.lastEvents)
+}
+
+// ewmaRateSnapshot is an immutable, point-in-time view of an ewmaRate,
+// letting a caller read rate, count, and the time of the last tick together
+// without them drifting relative to one another across separate calls.
+type ewmaRateSnapshot struct {
+	rate     float64
+	count    int64
+	lastTick time.Time
+}
+
+// snapshot returns a consistent, lock-free view of r as of its last tick():
+// rate, count, and lastTick all come from the same tick(), never a torn mix
+// of an old and a new one, because tick() stores them as a single value.
+func (r *ewmaRate) snapshot() ewmaRateSnapshot {
+	s, _ := r.snapshotValue.Load().(ewmaRateSnapshot)
+	return s
+}
+
+// tick assumes to be called every r.interval. It is the only place that
+// mutates rateBits, lastEvents, and snapshotValue, so it takes mutex to
+// serialize against concurrent tick() calls; rate(), count(), and
+// snapshot() never block on it.
+func (r *ewmaRate) tick() {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-	return r.lastRate
+
+	events := atomic.LoadInt64(&r.events)
+	lastEvents := atomic.LoadInt64(&r.lastEvents)
+	instantRate := float64(events-lastEvents) / r.interval.Seconds()
+
+	rate := r.rate()
+	if r.init {
+		rate += r.alpha * (instantRate - rate)
+	} else if events > 0 {
+		r.init = true
+		rate = instantRate
+	}
+	now := time.Now()
+
+	atomic.StoreUint64(&r.rateBits, math.Float64bits(rate))
+	atomic.StoreInt64(&r.lastEvents, events)
+	atomic.StoreInt64(&r.lastTickNano, now.UnixNano())
+	r.snapshotValue.Store(ewmaRateSnapshot{rate: rate, count: events, lastTick: now})
 }
 
-// count returns the total events recorded.
-func (r *ewmaRate) count() int64 {
+// incr counts incr events.
+func (r *ewmaRate) incr(incr int64) {
+	atomic.AddInt64(&r.events, incr)
+}
+
+// rateTracker is the interface a queue uses to record samples and read back
+// a rate, so that ewmaRate can be swapped out for a no-op or a
+// caller-supplied implementation in tests.
+type rateTracker interface {
+	incr(int64)
+	tick()
+	rate() float64
+	count() int64
+}
+
+var (
+	_ rateTracker = (*ewmaRate)(nil)
+	_ rateTracker = nilRateTracker{}
+	_ rateTracker = (*deterministicRateTracker)(nil)
+	_ rateTracker = (*multiEWMARate)(nil)
+)
+
+// multiRateTracker is the interface QueueManager depends on for the
+// 1m/5m/15m windows that drive calculateDesiredShards. It embeds
+// rateTracker so a multiRateTracker can still be registered with a
+// rateTicker like any other tracker; nilRateTracker and
+// deterministicRateTracker implement it too, so tests can inject a no-op or
+// a fixed-rate double and call calculateDesiredShards directly instead of
+// driving a real multiEWMARate through ticks.
+type multiRateTracker interface {
+	rateTracker
+	rate1() float64
+	rate5() float64
+	rate15() float64
+}
+
+var (
+	_ multiRateTracker = nilRateTracker{}
+	_ multiRateTracker = (*deterministicRateTracker)(nil)
+	_ multiRateTracker = (*multiEWMARate)(nil)
+)
+
+// nilRateTracker is a rateTracker that discards everything it is given, so
+// incr() costs no atomic add. NewQueueManager always uses a multiEWMARate;
+// nothing in this package switches a queue to nilRateTracker, which is only
+// used where a caller sets it as a tracker directly.
+type nilRateTracker struct{}
+
+func (nilRateTracker) incr(int64)      {}
+func (nilRateTracker) tick()           {}
+func (nilRateTracker) rate() float64   { return 0 }
+func (nilRateTracker) count() int64    { return 0 }
+func (nilRateTracker) rate1() float64  { return 0 }
+func (nilRateTracker) rate5() float64  { return 0 }
+func (nilRateTracker) rate15() float64 { return 0 }
+
+// deterministicRateTracker is a rateTracker whose rate() and count() return
+// caller-supplied values. It lets tests exercise shard-scaling decisions
+// directly, without driving a real ticker goroutine and sleeping for it to
+// tick. It also reports the same fixed rate from rate1(), rate5(), and
+// rate15(), so it doubles as a fixed-rate multiRateTracker for tests that
+// inject a tracker straight into a QueueManager.
+type deterministicRateTracker struct {
+	rateValue  float64
+	countValue int64
+}
+
+// newDeterministicRateTracker returns a rateTracker that always reports rate
+// and count, regardless of how many times incr() or tick() are called.
+func newDeterministicRateTracker(rate float64, count int64) *deterministicRateTracker {
+	return &deterministicRateTracker{rateValue: rate, countValue: count}
+}
+
+func (t *deterministicRateTracker) incr(int64)      {}
+func (t *deterministicRateTracker) tick()           {}
+func (t *deterministicRateTracker) rate() float64   { return t.rateValue }
+func (t *deterministicRateTracker) count() int64    { return t.countValue }
+func (t *deterministicRateTracker) rate1() float64  { return t.rateValue }
+func (t *deterministicRateTracker) rate5() float64  { return t.rateValue }
+func (t *deterministicRateTracker) rate15() float64 { return t.rateValue }
+
+// multiEWMARate tracks three exponentially weighted moving averages of the
+// same per-second rate, over 1-minute, 5-minute, and 15-minute windows,
+// analogous to the classic NewEWMA1/5/15 set used for Unix load averages.
+// Comparing the windows lets a caller tell a short spike (1m far above 15m)
+// apart from sustained load (all three windows in agreement), which a
+// single-window ewmaRate cannot do on its own.
+type multiEWMARate struct {
+	// Keep all 64bit atomically accessed variables at the top of this struct.
+	// See https://golang.org/pkg/sync/atomic/#pkg-note-BUG for more info.
+	events     int64
+	lastEvents int64
+
+	interval time.Duration
+	init     bool
+	mutex    sync.Mutex
+
+	alpha1, alpha5, alpha15          float64
+	lastRate1, lastRate5, lastRate15 float64
+}
+
+// newMultiEWMARate always allocates a new multiEWMARate, as this guarantees
+// the atomically accessed int64 will be aligned on ARM. See prometheus#2666.
+func newMultiEWMARate(interval time.Duration) *multiEWMARate {
+	seconds := interval.Seconds()
+	return &multiEWMARate{
+		interval: interval,
+		alpha1:   1 - math.Exp(-seconds/60/1),
+		alpha5:   1 - math.Exp(-seconds/60/5),
+		alpha15:  1 - math.Exp(-seconds/60/15),
+	}
+}
+
+// rate1 returns the per-second rate over the 1-minute window.
+func (r *multiEWMARate) rate1() float64 {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-	return r.lastEvents
+	return r.lastRate1
 }
 
-// tick assumes to be called every r.interval.
-func (r *ewmaRate) tick() {
+// rate5 returns the per-second rate over the 5-minute window.
+func (r *multiEWMARate) rate5() float64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.lastRate5
+}
+
+// rate15 returns the per-second rate over the 15-minute window.
+func (r *multiEWMARate) rate15() float64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.lastRate15
+}
+
+// tick assumes to be called every r.interval, and updates all three windows
+// from the same instantaneous rate.
+func (r *multiEWMARate) tick() {
 	events := atomic.LoadInt64(&r.events)
 
 	r.mutex.Lock()
@@ -67,14 +252,147 @@ func (r *ewmaRate) tick() {
 	r.lastEvents = events
 
 	if r.init {
-		r.lastRate += r.alpha * (instantRate - r.lastRate)
+		r.lastRate1 += r.alpha1 * (instantRate - r.lastRate1)
+		r.lastRate5 += r.alpha5 * (instantRate - r.lastRate5)
+		r.lastRate15 += r.alpha15 * (instantRate - r.lastRate15)
 	} else if events > 0 {
 		r.init = true
-		r.lastRate = instantRate
+		r.lastRate1 = instantRate
+		r.lastRate5 = instantRate
+		r.lastRate15 = instantRate
 	}
 }
 
-// inc counts one event.
-func (r *ewmaRate) incr(incr int64) {
+// incr counts incr events.
+func (r *multiEWMARate) incr(incr int64) {
 	atomic.AddInt64(&r.events, incr)
 }
+
+// rate satisfies rateTracker so a multiEWMARate can be registered directly
+// with a rateTicker alongside plain ewmaRates; it reports the 5-minute
+// window, matching the single-window ewmaRate it's used in place of.
+func (r *multiEWMARate) rate() float64 {
+	return r.rate5()
+}
+
+// count returns the total events recorded as of the last tick().
+func (r *multiEWMARate) count() int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.lastEvents
+}
+
+// defaultTickInterval is the base tick of the package-wide rateTicker
+// returned by defaultRateTicker, and the interval NewQueueManager gives its
+// multiEWMARate, so that the 1m/5m/15m windows are sampled at a common,
+// coherent cadence. A rateTicker made by newRateTicker uses whatever
+// interval it is given.
+const defaultTickInterval = 5 * time.Second
+
+// rateTicker drives tick() across every registered rateTracker from a
+// single goroutine, instead of each queue running its own time.Ticker. This
+// keeps the goroutine count flat as the number of remote-write queues
+// grows, and means every queue's rate is sampled at the same wall-clock
+// instants, which makes cross-queue diagnostics meaningful.
+type rateTicker struct {
+	interval time.Duration
+
+	mutex    sync.Mutex
+	trackers map[rateTracker]struct{}
+
+	tickNowCh chan struct{}
+	stopCh    chan struct{}
+}
+
+// newRateTicker allocates a rateTicker and starts the goroutine that drives
+// it; callers must eventually call stop().
+func newRateTicker(interval time.Duration) *rateTicker {
+	t := &rateTicker{
+		interval:  interval,
+		trackers:  make(map[rateTracker]struct{}),
+		tickNowCh: make(chan struct{}, 1),
+		stopCh:    make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+func (t *rateTicker) run() {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.tick()
+		case <-t.tickNowCh:
+			t.tick()
+		case <-t.stopCh:
+			return
+		}
+	}
+}
+
+func (t *rateTicker) tick() {
+	t.mutex.Lock()
+	trackers := make([]rateTracker, 0, len(t.trackers))
+	for tracker := range t.trackers {
+		trackers = append(trackers, tracker)
+	}
+	t.mutex.Unlock()
+
+	for _, tracker := range trackers {
+		tracker.tick()
+	}
+}
+
+// register adds tracker to the set ticked on every interval. A QueueManager
+// registers its trackers on start.
+func (t *rateTicker) register(tracker rateTracker) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.trackers[tracker] = struct{}{}
+}
+
+// unregister removes tracker from the set ticked on every interval. A
+// QueueManager deregisters its trackers on stop.
+func (t *rateTicker) unregister(tracker rateTracker) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.trackers, tracker)
+}
+
+// tickNow asks the ticker goroutine to tick all registered trackers without
+// waiting for the interval to elapse. It returns without waiting for that
+// tick to run, and a request made while another is still pending is dropped.
+// It is a test hook that lets tests advance rates on demand instead of
+// waiting for a real tick.
+func (t *rateTicker) tickNow() {
+	select {
+	case t.tickNowCh <- struct{}{}:
+	default:
+	}
+}
+
+// stop shuts down the ticker goroutine. It does not wait for an in-flight
+// tick to finish.
+func (t *rateTicker) stop() {
+	close(t.stopCh)
+}
+
+var (
+	defaultRateTickerOnce sync.Once
+	defaultRateTickerInst *rateTicker
+)
+
+// defaultRateTicker returns the package-wide scheduler, which ticks every
+// defaultTickInterval. NewQueueManager does not fall back to it; a queue is
+// registered with whichever ticker is passed to NewQueueManager. Its
+// goroutine is started lazily, on first use, so
+// that merely importing this package (e.g. from go test) never leaks a
+// ticker goroutine that nothing registers trackers with.
+func defaultRateTicker() *rateTicker {
+	defaultRateTickerOnce.Do(func() {
+		defaultRateTickerInst = newRateTicker(defaultTickInterval)
+	})
+	return defaultRateTickerInst
+}
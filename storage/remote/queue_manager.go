@@ -0,0 +1,169 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scaleTrendConfirmTicks is how many consecutive calls of
+// calculateDesiredShards the 1-minute window must agree with the direction
+// implied by max(rate5, rate15) before calculateDesiredShards acts on it. This keeps a brief spike or lull on the
+// short window from forcing a shard change the sustained rate doesn't
+// support.
+const scaleTrendConfirmTicks = 2
+
+// samplesPerShard is the per-second sample throughput a single shard is
+// assumed able to sustain. calculateDesiredShards divides the desired
+// throughput by this to arrive at a shard count.
+const samplesPerShard = 1000.0
+
+// QueueManagerConfig bounds the shard count calculateDesiredShards is
+// allowed to choose for a QueueManager.
+type QueueManagerConfig struct {
+	MinShards int
+	MaxShards int
+}
+
+// QueueManager drives the shard count of a single remote-write queue from
+// the 1m/5m/15m rates of the samples it takes in, so a short spike and
+// sustained load produce different scaling behavior.
+type QueueManager struct {
+	cfg QueueManagerConfig
+
+	numShards int
+
+	dataIn multiRateTracker
+
+	scaleUpTrend   int
+	scaleDownTrend int
+
+	metrics *queueManagerMetrics
+}
+
+// NewQueueManager creates a QueueManager with numShards starting at
+// cfg.MinShards, and registers its rate tracker with ticker so it ticks in
+// lock-step with every other queue. Callers must call stop() on shutdown to
+// unregister it.
+func NewQueueManager(cfg QueueManagerConfig, metrics *queueManagerMetrics, ticker *rateTicker) *QueueManager {
+	t := &QueueManager{
+		cfg:       cfg,
+		numShards: cfg.MinShards,
+		dataIn:    newMultiEWMARate(defaultTickInterval),
+		metrics:   metrics,
+	}
+	ticker.register(t.dataIn)
+	return t
+}
+
+// stop unregisters t's rate tracker from ticker.
+func (t *QueueManager) stop(ticker *rateTicker) {
+	ticker.unregister(t.dataIn)
+}
+
+// appendSample counts one incoming sample towards the shard calculation.
+func (t *QueueManager) appendSample() {
+	t.dataIn.incr(1)
+}
+
+// calculateDesiredShards returns the shard count the queue should run with,
+// given the multi-window rate of incoming samples. It uses max(rate5,
+// rate15) as the desired throughput, but only changes numShards once rate1
+// has confirmed the direction of that change for scaleTrendConfirmTicks
+// consecutive calls, in either direction.
+func (t *QueueManager) calculateDesiredShards() int {
+	t.updateMetrics()
+
+	desiredThroughput := math.Max(t.dataIn.rate5(), t.dataIn.rate15())
+	desiredShards := int(math.Ceil(desiredThroughput / samplesPerShard))
+	if desiredShards < t.cfg.MinShards {
+		desiredShards = t.cfg.MinShards
+	}
+	if desiredShards > t.cfg.MaxShards {
+		desiredShards = t.cfg.MaxShards
+	}
+
+	switch {
+	case desiredShards > t.numShards:
+		if t.dataIn.rate1() < desiredThroughput {
+			// The short window hasn't caught up with the trend yet, so this
+			// call doesn't confirm it; the run of confirming calls restarts.
+			t.scaleUpTrend = 0
+			return t.numShards
+		}
+		t.scaleDownTrend = 0
+		t.scaleUpTrend++
+		if t.scaleUpTrend < scaleTrendConfirmTicks {
+			return t.numShards
+		}
+	case desiredShards < t.numShards:
+		if t.dataIn.rate1() > desiredThroughput {
+			// Symmetric damping on the way down: while the 1m window is
+			// still above the 5m/15m throughput it hasn't confirmed the
+			// drop, so no shards are shed and the run of confirming calls
+			// restarts.
+			t.scaleDownTrend = 0
+			return t.numShards
+		}
+		t.scaleUpTrend = 0
+		t.scaleDownTrend++
+		if t.scaleDownTrend < scaleTrendConfirmTicks {
+			return t.numShards
+		}
+	default:
+		t.scaleUpTrend, t.scaleDownTrend = 0, 0
+		return t.numShards
+	}
+
+	t.numShards = desiredShards
+	return t.numShards
+}
+
+// updateMetrics publishes the current 1m/5m/15m incoming-sample rates, if
+// metrics were supplied.
+func (t *QueueManager) updateMetrics() {
+	if t.metrics == nil {
+		return
+	}
+	t.metrics.samplesInRate.WithLabelValues("1m").Set(t.dataIn.rate1())
+	t.metrics.samplesInRate.WithLabelValues("5m").Set(t.dataIn.rate5())
+	t.metrics.samplesInRate.WithLabelValues("15m").Set(t.dataIn.rate15())
+}
+
+// queueManagerMetrics holds the prometheus_remote_storage_samples_in_rate
+// gauges, one per EWMA window, for a single QueueManager.
+type queueManagerMetrics struct {
+	samplesInRate *prometheus.GaugeVec
+}
+
+// newQueueManagerMetrics creates the samples-in-rate gauge vec, labeled by
+// remote_name and url like the rest of this package's remote-write metrics,
+// and registers it with reg if reg is non-nil.
+func newQueueManagerMetrics(reg prometheus.Registerer, remoteName, endpoint string) *queueManagerMetrics {
+	m := &queueManagerMetrics{
+		samplesInRate: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   "prometheus",
+			Subsystem:   "remote_storage",
+			Name:        "samples_in_rate",
+			Help:        "Rate of samples read into the remote write queue, per EWMA window.",
+			ConstLabels: prometheus.Labels{"remote_name": remoteName, "url": endpoint},
+		}, []string{"window"}),
+	}
+	if reg != nil {
+		reg.MustRegister(m.samplesInRate)
+	}
+	return m
+}
@@ -0,0 +1,154 @@
+// Copyright 2013 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"testing"
+	"time"
+)
+
+// driveShards runs n ticks of desiredRate samples/sec through t.dataIn and
+// calls calculateDesiredShards after each one, returning the final shard
+// count. It lets tests drive the trend-confirmation logic deterministically
+// instead of sleeping for a real ticker.
+func driveShards(t *QueueManager, desiredRate float64, n int) int {
+	var shards int
+	for i := 0; i < n; i++ {
+		t.dataIn.incr(int64(desiredRate))
+		t.dataIn.tick()
+		shards = t.calculateDesiredShards()
+	}
+	return shards
+}
+
+func TestCalculateDesiredShardsIgnoresSingleTickSpike(t *testing.T) {
+	qm := &QueueManager{
+		cfg:       QueueManagerConfig{MinShards: 1, MaxShards: 10},
+		numShards: 1,
+		dataIn:    newMultiEWMARate(defaultTickInterval),
+	}
+
+	// The first nonzero tick sets all three windows to the same large rate,
+	// so more shards are called for, but rate1 has confirmed that for only
+	// one call, fewer than scaleTrendConfirmTicks.
+	qm.dataIn.incr(100000)
+	qm.dataIn.tick()
+	if got := qm.calculateDesiredShards(); got != 1 {
+		t.Errorf("calculateDesiredShards() after one spike tick = %d, want 1 (unconfirmed)", got)
+	}
+}
+
+func TestCalculateDesiredShardsScalesUpAfterSustainedLoad(t *testing.T) {
+	qm := &QueueManager{
+		cfg:       QueueManagerConfig{MinShards: 1, MaxShards: 10},
+		numShards: 1,
+		dataIn:    newMultiEWMARate(defaultTickInterval),
+	}
+
+	// Drive enough ticks at a high, sustained rate for rate1 to confirm the
+	// trend for scaleTrendConfirmTicks calls in a row.
+	got := driveShards(qm, 20000, 30)
+	if got <= 1 {
+		t.Errorf("calculateDesiredShards() after sustained load = %d, want > 1", got)
+	}
+}
+
+func TestCalculateDesiredShardsScalesDownAfterSustainedLull(t *testing.T) {
+	qm := &QueueManager{
+		cfg:       QueueManagerConfig{MinShards: 1, MaxShards: 10},
+		numShards: 5,
+		dataIn:    newMultiEWMARate(defaultTickInterval),
+	}
+
+	// Prime the windows at 5000 samples/sec so they agree the current 5
+	// shards are warranted, then drop the rate to zero and hold it there
+	// long enough for rate15, which decays slowest, to fall below 4000.
+	primed := driveShards(qm, 25000, 30)
+	got := driveShards(qm, 0, 60)
+	if got >= primed {
+		t.Errorf("calculateDesiredShards() after sustained lull = %d, want it to have scaled down from %d", got, primed)
+	}
+}
+
+func TestCalculateDesiredShardsRespectsMinMaxShards(t *testing.T) {
+	qm := &QueueManager{
+		cfg:       QueueManagerConfig{MinShards: 2, MaxShards: 3},
+		numShards: 2,
+		dataIn:    newMultiEWMARate(defaultTickInterval),
+	}
+
+	// With no samples at all, the shard count stays at MinShards even once
+	// scaleTrendConfirmTicks calls have passed.
+	for i := 0; i < scaleTrendConfirmTicks; i++ {
+		if got := qm.calculateDesiredShards(); got != qm.cfg.MinShards {
+			t.Fatalf("calculateDesiredShards() with no load = %d, want MinShards=%d", got, qm.cfg.MinShards)
+		}
+	}
+
+	got := driveShards(qm, 1e9, 30)
+	if got != qm.cfg.MaxShards {
+		t.Errorf("calculateDesiredShards() under huge sustained load = %d, want capped at MaxShards=%d", got, qm.cfg.MaxShards)
+	}
+}
+
+// TestCalculateDesiredShardsWithDeterministicTracker injects a
+// deterministicRateTracker instead of a real multiEWMARate, so the shard
+// calculator can be exercised directly against a fixed rate without driving
+// any ticks at all.
+func TestCalculateDesiredShardsWithDeterministicTracker(t *testing.T) {
+	qm := &QueueManager{
+		cfg:       QueueManagerConfig{MinShards: 1, MaxShards: 10},
+		numShards: 1,
+		dataIn:    newDeterministicRateTracker(5000, 0),
+	}
+
+	// The fixed rate confirms the same direction on every call, so the
+	// trend check takes scaleTrendConfirmTicks calls to act, with no ticks
+	// or sleeping involved.
+	for i := 0; i < scaleTrendConfirmTicks-1; i++ {
+		if got := qm.calculateDesiredShards(); got != 1 {
+			t.Fatalf("calculateDesiredShards() call %d = %d, want 1 (unconfirmed)", i, got)
+		}
+	}
+	if got := qm.calculateDesiredShards(); got != 5 {
+		t.Errorf("calculateDesiredShards() after confirmation = %d, want 5", got)
+	}
+}
+
+// TestNewQueueManagerRegistersAndStopUnregisters checks that the real
+// constructor and stop() actually add and remove the tracker from the
+// ticker, so a QueueManager can't leak a registration across restarts.
+func TestNewQueueManagerRegistersAndStopUnregisters(t *testing.T) {
+	rt := newRateTicker(time.Hour)
+	defer rt.stop()
+
+	metrics := newQueueManagerMetrics(nil, "test", "http://example.com/api/write")
+	qm := NewQueueManager(QueueManagerConfig{MinShards: 1, MaxShards: 10}, metrics, rt)
+
+	rt.mutex.Lock()
+	_, registered := rt.trackers[qm.dataIn]
+	rt.mutex.Unlock()
+	if !registered {
+		t.Fatal("NewQueueManager did not register its tracker with the ticker")
+	}
+
+	qm.stop(rt)
+
+	rt.mutex.Lock()
+	_, stillRegistered := rt.trackers[qm.dataIn]
+	rt.mutex.Unlock()
+	if stillRegistered {
+		t.Error("stop() did not unregister the tracker from the ticker")
+	}
+}